@@ -1,17 +1,11 @@
 package app
 
 import (
-	"bufio"
-	"compress/gzip"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"context"
@@ -22,7 +16,6 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/ugorji/go/codec"
 	"github.com/weaveworks/scope/common/xfer"
 	"github.com/weaveworks/scope/render"
 	"github.com/weaveworks/scope/render/detailed"
@@ -31,6 +24,10 @@ import (
 
 const (
 	websocketLoop = 1 * time.Second
+	// websocketDeadlineFactor is the default multiple of the loop
+	// interval allowed for a single write before the peer is considered
+	// stuck; ?write_timeout= overrides it.
+	websocketDeadlineFactor = 3
 )
 
 // APITopology is returned by the /api/topology/{name} handler.
@@ -64,69 +61,6 @@ func handleTopology(ctx context.Context, renderer render.Renderer, transformer r
 	})
 }
 
-// WriteToFile writes a Report to a file. The encoding is determined
-// by the file extension (".msgpack" or ".json", with an optional
-// ".gz").
-func WriteToFile(path string, rep APINode) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	msgpack, gzipped, err := fileType(path)
-	if err != nil {
-		return err
-	}
-
-	var w io.Writer
-	bufwriter := bufio.NewWriter(f)
-	defer bufwriter.Flush()
-	w = bufwriter
-	if gzipped {
-		gzwriter := gzipWriterPool.Get().(*gzip.Writer)
-		gzwriter.Reset(w)
-		defer gzipWriterPool.Put(gzwriter)
-		defer gzwriter.Close()
-		w = gzwriter
-	}
-
-	return codec.NewEncoder(w, codecHandle(msgpack)).Encode(rep)
-}
-func codecHandle(msgpack int) codec.Handle {
-	if (msgpack == 0) {
-		return &codec.JsonHandle{}
-	} else if (msgpack == 1) {
-		return &codec.MsgpackHandle{}
-	} else if (msgpack == 2) {
-		return &codec.BincHandle{}
-	}
-	return nil
-}
-var gzipWriterPool = &sync.Pool{
-	// NewWriterLevel() only errors if the compression level is invalid, which can't happen here
-	New: func() interface{} { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w },
-}
-
-func fileType(path string) (msgpack int, gzipped bool, err error) {
-	fileType := filepath.Ext(path)
-	gzipped = false
-	if fileType == ".gz" {
-		gzipped = true
-		fileType = filepath.Ext(strings.TrimSuffix(path, fileType))
-	}
-	switch fileType {
-	case ".json":
-		return 0, gzipped, nil
-	case ".msgpack":
-		return 1, gzipped, nil
-	case ".binc":
-		return 2, gzipped, nil
-	default:
-		return 3, false, fmt.Errorf("Unsupported file extension: %v", fileType)
-	}
-}
-
 // Individual nodes.
 func handleNode(ctx context.Context, renderer render.Renderer, transformer render.Transformer, rc detailed.RenderContext, w http.ResponseWriter, r *http.Request) {
 	var (
@@ -157,7 +91,7 @@ func handleNode(ctx context.Context, renderer render.Renderer, transformer rende
 	rawNode := detailed.MakeNode(topologyID, rc, nodes.Nodes, node)
 	respondWith(ctx, w, http.StatusOK, APINode{Node: detailed.CensorNode(rawNode, censorCfg)})
 	fmt.Println("Responding /topology/hosts: "+"var/log/response.json")
-	WriteToFile("var/log/response.json", APINode{Node: detailed.CensorNode(rawNode, censorCfg)})
+	WriteToFile("var/log/response.json", APINode{Node: detailed.CensorNode(rawNode, censorCfg)}, WriteOptions{Format: FormatJSON})
 }
 
 // Websocket for the full topology.
@@ -179,6 +113,16 @@ func handleWebsocket(
 			return
 		}
 	}
+	// There's deliberately no ?read_timeout= - see the reader goroutine
+	// below, which treats an idle read as normal rather than a deadline.
+	writeTimeout := websocketDeadlineFactor * loop
+	if wt := r.Form.Get("write_timeout"); wt != "" {
+		var err error
+		if writeTimeout, err = time.ParseDuration(wt); err != nil {
+			respondWith(ctx, w, http.StatusBadRequest, wt)
+			return
+		}
+	}
 
 	conn, err := xfer.Upgrade(w, r, nil)
 	if err != nil {
@@ -187,19 +131,6 @@ func handleWebsocket(
 	}
 	defer conn.Close()
 
-	quit := make(chan struct{})
-	go func(c xfer.Websocket) {
-		for { // just discard everything the browser sends
-			if _, _, err := c.ReadMessage(); err != nil {
-				if !xfer.IsExpectedWSCloseError(err) {
-					log.Error("err:", err)
-				}
-				close(quit)
-				break
-			}
-		}
-	}(conn)
-
 	wc := websocketState{
 		rep:              rep,
 		values:           r.Form,
@@ -208,7 +139,11 @@ func handleWebsocket(
 		startReportingAt: deserializeTimestamp(r.Form.Get("timestamp")),
 		censorCfg:        report.GetCensorConfigFromRequest(r),
 		channelOpenedAt:  time.Now(),
+		writeTimeout:     writeTimeout,
+		deadline:         newDeadlineTimer(),
+		readErr:          make(chan error, 1),
 	}
+	defer wc.deadline.stop()
 	adjacencyStr := r.Form.Get("adjacency")
 	if adjacencyStr == "false" {
 		wc.adjacency = false
@@ -216,6 +151,17 @@ func handleWebsocket(
 		wc.adjacency = true
 	}
 
+	// The browser rarely sends anything on this one-way stream, so
+	// blocking here is normal; readErr only fires on a real close/error.
+	go func() {
+		for { // just discard everything the browser sends
+			if _, _, err := wc.conn.ReadMessage(); err != nil {
+				wc.readErr <- err
+				return
+			}
+		}
+	}()
+
 	wait := make(chan struct{}, 1)
 	rep.WaitOn(ctx, wait)
 	defer rep.UnWait(ctx, wait)
@@ -230,7 +176,10 @@ func handleWebsocket(
 		select {
 		case <-wait:
 		case <-tick:
-		case <-quit:
+		case err := <-wc.readErr:
+			if !xfer.IsExpectedWSCloseError(err) {
+				log.Error("err:", err)
+			}
 			return
 		}
 	}
@@ -247,6 +196,28 @@ type websocketState struct {
 	censorCfg        report.CensorConfig
 	channelOpenedAt  time.Time
 	adjacency        bool
+	writeTimeout     time.Duration
+	deadline         *deadlineTimer
+	readErr          chan error
+}
+
+// writeJSON writes v, returning os.ErrDeadlineExceeded if it doesn't
+// finish within writeTimeout. On timeout it closes conn to unblock the
+// stuck write, rather than abandon it writing in the background where
+// it could race a later call.
+func (wc *websocketState) writeJSON(v interface{}) error {
+	wc.deadline.SetWriteDeadline(wc.writeTimeout)
+	done := make(chan error, 1)
+	go func() {
+		done <- wc.conn.WriteJSON(v)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-wc.deadline.writeDone():
+		wc.conn.Close()
+		return os.ErrDeadlineExceeded
+	}
 }
 
 func (wc *websocketState) update(ctx context.Context) error {
@@ -287,7 +258,7 @@ func (wc *websocketState) update(ctx context.Context) error {
 	diff := detailed.TopoDiff(wc.previousTopo, newTopo)
 	wc.previousTopo = newTopo
 
-	if err := wc.conn.WriteJSON(diff); err != nil {
+	if err := wc.writeJSON(diff); err != nil {
 		if !xfer.IsExpectedWSCloseError(err) {
 			return errors.Wrap(err, "cannot serialize topology diff")
 		}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ugorji/go/codec"
+)
+
+// Format identifies the wire encoding of a serialized report/node.
+type Format string
+
+const (
+	FormatJSON    Format = "json"
+	FormatMsgpack Format = "msgpack"
+	FormatBinc    Format = "binc"
+	FormatCBOR    Format = "cbor"
+)
+
+// Compression identifies the streaming compression wrapped around an
+// encoded payload. CompressionNone leaves the payload unwrapped.
+type Compression string
+
+const (
+	CompressionNone   Compression = ""
+	CompressionGzip   Compression = "gzip"
+	CompressionZstd   Compression = "zstd"
+	CompressionBrotli Compression = "br"
+)
+
+// WriteOptions controls how WriteToFile encodes and compresses a payload,
+// replacing sniffing the format out of the filename (ReadFromFile takes no
+// options; it sniffs the file's leading bytes). Level is ignored when
+// Compression is CompressionNone and is otherwise passed to the chosen
+// compressor on its own scale; 0 is a valid level (e.g.
+// gzip.NoCompression), not "unset". For gzip, gzip.DefaultCompression (-1)
+// gives the usual default; zstd and brotli treat -1 as their fastest
+// setting.
+type WriteOptions struct {
+	Format      Format
+	Compression Compression
+	Level       int
+}
+
+// codecEntry is one entry of the codec registry below, keyed by file
+// extension: a format entry supplies newHandle, a compression entry
+// supplies newWriter/newReader. Either half may be nil.
+type codecEntry struct {
+	newHandle func() codec.Handle
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecRegistry = map[string]codecEntry{
+	".json":    {newHandle: func() codec.Handle { return &codec.JsonHandle{} }},
+	".msgpack": {newHandle: func() codec.Handle { return &codec.MsgpackHandle{} }},
+	".binc":    {newHandle: func() codec.Handle { return &codec.BincHandle{} }},
+	".cbor":    {newHandle: func() codec.Handle { return &codec.CborHandle{} }},
+	".gz": {
+		newWriter: newPooledGzipWriter,
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	".zst": {
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+	".br": {
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			// Brotli has no magic number of its own; stamp brotliMagic
+			// ahead of the stream so sniffCompression can recognize it.
+			if _, err := w.Write(brotliMagic); err != nil {
+				return nil, err
+			}
+			return brotli.NewWriterLevel(w, level), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			magic := make([]byte, len(brotliMagic))
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(magic, brotliMagic) {
+				return nil, fmt.Errorf("report: missing brotli magic")
+			}
+			return ioutil.NopCloser(brotli.NewReader(r)), nil
+		},
+	},
+}
+
+func formatExt(f Format) string {
+	return "." + string(f)
+}
+
+func compressionExt(c Compression) string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	case CompressionBrotli:
+		return ".br"
+	default:
+		return ""
+	}
+}
+
+// gzipWriterPools holds one sync.Pool of *gzip.Writer per compression
+// level.
+var gzipWriterPools sync.Map // map[int]*sync.Pool
+
+func gzipWriterPoolForLevel(level int) *sync.Pool {
+	if p, ok := gzipWriterPools.Load(level); ok {
+		return p.(*sync.Pool)
+	}
+	pool := &sync.Pool{
+		// NewWriterLevel() only errors on an invalid level, which can't
+		// happen here since newPooledGzipWriter rejects those first.
+		New: func() interface{} { w, _ := gzip.NewWriterLevel(ioutil.Discard, level); return w },
+	}
+	p, _ := gzipWriterPools.LoadOrStore(level, pool)
+	return p.(*sync.Pool)
+}
+
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	p.pool.Put(p.Writer)
+	return err
+}
+
+func newPooledGzipWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip: invalid compression level: %d", level)
+	}
+	pool := gzipWriterPoolForLevel(level)
+	gzwriter := pool.Get().(*gzip.Writer)
+	gzwriter.Reset(w)
+	return &pooledGzipWriter{Writer: gzwriter, pool: pool}, nil
+}
+
+// WriteToFile writes rep to path, encoded and compressed as described by
+// opts.
+func WriteToFile(path string, rep APINode, opts WriteOptions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	formatEntry, ok := codecRegistry[formatExt(opts.Format)]
+	if !ok || formatEntry.newHandle == nil {
+		return fmt.Errorf("Unsupported format: %v", opts.Format)
+	}
+
+	bufwriter := bufio.NewWriter(f)
+	defer bufwriter.Flush()
+	var w io.Writer = bufwriter
+
+	if opts.Compression != CompressionNone {
+		compEntry, ok := codecRegistry[compressionExt(opts.Compression)]
+		if !ok || compEntry.newWriter == nil {
+			return fmt.Errorf("Unsupported compression: %v", opts.Compression)
+		}
+		cw, err := compEntry.newWriter(w, opts.Level)
+		if err != nil {
+			return err
+		}
+		defer cw.Close()
+		w = cw
+	}
+
+	return codec.NewEncoder(w, formatEntry.newHandle()).Encode(rep)
+}
+
+// gzipMagic/zstdMagic are the leading bytes that let ReadFromFile
+// autodetect compression. brotliMagic isn't a real brotli signature -
+// the format doesn't have one - it's the marker the ".br" codecEntry
+// prepends on write and strips on read.
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+var brotliMagic = []byte{0x8b, 0x42, 0x52, 0xd1}
+
+func sniffCompression(br *bufio.Reader) (Compression, error) {
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return CompressionNone, err
+	}
+	switch {
+	case len(head) >= 2 && head[0] == gzipMagic[0] && head[1] == gzipMagic[1]:
+		return CompressionGzip, nil
+	case len(head) >= 4 && head[0] == zstdMagic[0] && head[1] == zstdMagic[1] && head[2] == zstdMagic[2] && head[3] == zstdMagic[3]:
+		return CompressionZstd, nil
+	case len(head) >= 4 && bytes.Equal(head, brotliMagic):
+		return CompressionBrotli, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+// sniffFormat guesses the format from its leading byte. JSON and CBOR
+// have reliable leading bytes; msgpack and binc don't, so this is a
+// best-effort heuristic, good enough for files this package wrote itself.
+func sniffFormat(br *bufio.Reader) (Format, error) {
+	head, err := br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	switch b := head[0]; {
+	case b == '{' || b == '[':
+		return FormatJSON, nil
+	case b >= 0xa0 && b <= 0xbf:
+		return FormatCBOR, nil
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		return FormatMsgpack, nil
+	default:
+		return FormatBinc, nil
+	}
+}
+
+// ReadFromFile reads back whatever WriteToFile wrote, autodetecting both
+// the compression and the format from their magic bytes instead of
+// relying on the filename.
+func ReadFromFile(path string) (*APINode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	compression, err := sniffCompression(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only re-wrap in bufio.Reader when decompressing: sniffFormat needs
+	// to Peek, which the compression readers don't support directly.
+	br2 := br
+	if compression != CompressionNone {
+		entry := codecRegistry[compressionExt(compression)]
+		cr, err := entry.newReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer cr.Close()
+		br2 = bufio.NewReader(cr)
+	}
+
+	format, err := sniffFormat(br2)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := codecRegistry[formatExt(format)]
+	if !ok || entry.newHandle == nil {
+		return nil, fmt.Errorf("Unsupported format: %v", format)
+	}
+
+	var rep APINode
+	if err := codec.NewDecoder(br2, entry.newHandle()).Decode(&rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer arms a cancelable write deadline for a connection with
+// no native deadline support: a goroutine blocked on the write selects
+// on the channel writeDone returns, which closes when the timer fires.
+//
+// There's no read-side equivalent - an idle read is normal, not stuck
+// (see websocketState.readErr) - only a slow write needs bounding.
+type deadlineTimer struct {
+	mu sync.Mutex
+
+	writeTimer  *time.Timer
+	writeCancel chan struct{}
+}
+
+func newDeadlineTimer() *deadlineTimer {
+	return &deadlineTimer{
+		writeCancel: make(chan struct{}),
+	}
+}
+
+// SetWriteDeadline stops any pending write deadline and arms a new one
+// that closes the channel returned by writeDone after d.
+func (dt *deadlineTimer) SetWriteDeadline(d time.Duration) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.writeTimer != nil {
+		dt.writeTimer.Stop()
+	}
+	cancel := make(chan struct{})
+	dt.writeCancel = cancel
+	dt.writeTimer = time.AfterFunc(d, func() { close(cancel) })
+}
+
+// writeDone returns the channel that closes when the current write
+// deadline elapses.
+func (dt *deadlineTimer) writeDone() <-chan struct{} {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.writeCancel
+}
+
+// stop disarms the timer, e.g. once the connection is being torn down.
+func (dt *deadlineTimer) stop() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.writeTimer != nil {
+		dt.writeTimer.Stop()
+	}
+}
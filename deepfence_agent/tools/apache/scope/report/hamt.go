@@ -0,0 +1,277 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+
+	"github.com/weaveworks/ps"
+)
+
+// hamtShift is the number of hash bits consumed at each level of the
+// trie, giving a branching factor of 32 per node.
+const hamtShift = 5
+const hamtMask = (1 << hamtShift) - 1
+
+// hamtMaxShift is the shift at which we stop branching and fall back to
+// a flat bucket of entries sharing the same 60-bit hash prefix.
+const hamtMaxShift = 60
+
+// hamtEntry is a single key/value pair stored at a trie leaf.
+type hamtEntry struct {
+	key   string
+	value interface{}
+}
+
+// hamtNode is an internal branch of the trie. bitmap records which of
+// the 32 possible slots at this level are populated, so a slot's
+// position in children can be recovered with a popcount.
+type hamtNode struct {
+	bitmap   uint32
+	children []interface{} // each is either *hamtNode or *hamtLeaf
+}
+
+// hamtLeaf holds every entry that hashes identically from this depth
+// down. Usually just one entry; more only on a genuine collision.
+type hamtLeaf struct {
+	entries []hamtEntry
+}
+
+func hamtHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// hamtSet returns a new node with key/value inserted, sharing as much
+// structure with n as possible, plus whether key was previously absent.
+func hamtSet(n interface{}, hash uint64, shift uint, key string, value interface{}) (interface{}, bool) {
+	if n == nil {
+		return &hamtLeaf{entries: []hamtEntry{{key, value}}}, true
+	}
+	switch t := n.(type) {
+	case *hamtLeaf:
+		for i, e := range t.entries {
+			if e.key == key {
+				entries := make([]hamtEntry, len(t.entries))
+				copy(entries, t.entries)
+				entries[i] = hamtEntry{key, value}
+				return &hamtLeaf{entries: entries}, false
+			}
+		}
+		if shift >= hamtMaxShift {
+			entries := make([]hamtEntry, len(t.entries)+1)
+			copy(entries, t.entries)
+			entries[len(t.entries)] = hamtEntry{key, value}
+			return &hamtLeaf{entries: entries}, true
+		}
+		// Two different keys map to the same slot: push them both down
+		// a level and let the branch separate them by their next bits.
+		var node interface{} = &hamtNode{}
+		for _, e := range t.entries {
+			node, _ = hamtSet(node, hamtHash(e.key), shift, e.key, e.value)
+		}
+		node, _ = hamtSet(node, hash, shift, key, value)
+		return node, true
+	case *hamtNode:
+		idx := (hash >> shift) & hamtMask
+		bit := uint32(1) << idx
+		pos := bits.OnesCount32(t.bitmap & (bit - 1))
+		if t.bitmap&bit == 0 {
+			children := make([]interface{}, len(t.children)+1)
+			copy(children[:pos], t.children[:pos])
+			children[pos] = &hamtLeaf{entries: []hamtEntry{{key, value}}}
+			copy(children[pos+1:], t.children[pos:])
+			return &hamtNode{bitmap: t.bitmap | bit, children: children}, true
+		}
+		newChild, isNew := hamtSet(t.children[pos], hash, shift+hamtShift, key, value)
+		children := make([]interface{}, len(t.children))
+		copy(children, t.children)
+		children[pos] = newChild
+		return &hamtNode{bitmap: t.bitmap, children: children}, isNew
+	}
+	panic("report: corrupt hamt node")
+}
+
+// hamtDelete returns a new node with key removed, plus whether it was
+// present at all.
+func hamtDelete(n interface{}, hash uint64, shift uint, key string) (interface{}, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch t := n.(type) {
+	case *hamtLeaf:
+		for i, e := range t.entries {
+			if e.key != key {
+				continue
+			}
+			if len(t.entries) == 1 {
+				return nil, true
+			}
+			entries := make([]hamtEntry, 0, len(t.entries)-1)
+			entries = append(entries, t.entries[:i]...)
+			entries = append(entries, t.entries[i+1:]...)
+			return &hamtLeaf{entries: entries}, true
+		}
+		return n, false
+	case *hamtNode:
+		idx := (hash >> shift) & hamtMask
+		bit := uint32(1) << idx
+		if t.bitmap&bit == 0 {
+			return n, false
+		}
+		pos := bits.OnesCount32(t.bitmap & (bit - 1))
+		newChild, deleted := hamtDelete(t.children[pos], hash, shift+hamtShift, key)
+		if !deleted {
+			return n, false
+		}
+		if newChild == nil {
+			if len(t.children) == 1 {
+				return nil, true
+			}
+			children := make([]interface{}, 0, len(t.children)-1)
+			children = append(children, t.children[:pos]...)
+			children = append(children, t.children[pos+1:]...)
+			return &hamtNode{bitmap: t.bitmap &^ bit, children: children}, true
+		}
+		children := make([]interface{}, len(t.children))
+		copy(children, t.children)
+		children[pos] = newChild
+		return &hamtNode{bitmap: t.bitmap, children: children}, true
+	}
+	panic("report: corrupt hamt node")
+}
+
+func hamtLookup(n interface{}, hash uint64, shift uint, key string) (interface{}, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch t := n.(type) {
+	case *hamtLeaf:
+		for _, e := range t.entries {
+			if e.key == key {
+				return e.value, true
+			}
+		}
+		return nil, false
+	case *hamtNode:
+		idx := (hash >> shift) & hamtMask
+		bit := uint32(1) << idx
+		if t.bitmap&bit == 0 {
+			return nil, false
+		}
+		pos := bits.OnesCount32(t.bitmap & (bit - 1))
+		return hamtLookup(t.children[pos], hash, shift+hamtShift, key)
+	}
+	panic("report: corrupt hamt node")
+}
+
+func hamtForEach(n interface{}, f func(key string, val interface{})) {
+	if n == nil {
+		return
+	}
+	switch t := n.(type) {
+	case *hamtLeaf:
+		for _, e := range t.entries {
+			f(e.key, e.value)
+		}
+	case *hamtNode:
+		for _, c := range t.children {
+			hamtForEach(c, f)
+		}
+	}
+}
+
+// HAMT is a persistent hash-array-mapped trie implementing ps.Map. Every
+// Set/Delete builds a new root by structural sharing instead of
+// mutating in place, so a HAMT can be read concurrently without locking.
+type HAMT struct {
+	root interface{} // *hamtNode, *hamtLeaf, or nil when empty
+	size int
+}
+
+// NewHAMT returns an empty HAMT.
+func NewHAMT() *HAMT {
+	return &HAMT{}
+}
+
+func (h *HAMT) IsNil() bool {
+	return h == nil
+}
+
+func (h *HAMT) Set(key string, value interface{}) ps.Map {
+	if h == nil {
+		h = NewHAMT()
+	}
+	root, isNew := hamtSet(h.root, hamtHash(key), 0, key, value)
+	size := h.size
+	if isNew {
+		size++
+	}
+	return &HAMT{root: root, size: size}
+}
+
+// UnsafeMutableSet mutates h's root in place and returns h, rather than
+// building a fresh value - only safe when nothing else holds h.
+func (h *HAMT) UnsafeMutableSet(key string, value interface{}) ps.Map {
+	if h == nil {
+		return NewHAMT().Set(key, value)
+	}
+	root, isNew := hamtSet(h.root, hamtHash(key), 0, key, value)
+	h.root = root
+	if isNew {
+		h.size++
+	}
+	return h
+}
+
+func (h *HAMT) Delete(key string) ps.Map {
+	if h == nil || h.root == nil {
+		return h
+	}
+	root, deleted := hamtDelete(h.root, hamtHash(key), 0, key)
+	if !deleted {
+		return h
+	}
+	return &HAMT{root: root, size: h.size - 1}
+}
+
+func (h *HAMT) Lookup(key string) (interface{}, bool) {
+	if h == nil {
+		return nil, false
+	}
+	return hamtLookup(h.root, hamtHash(key), 0, key)
+}
+
+func (h *HAMT) Size() int {
+	if h == nil {
+		return 0
+	}
+	return h.size
+}
+
+func (h *HAMT) ForEach(f func(key string, val interface{})) {
+	if h == nil {
+		return
+	}
+	hamtForEach(h.root, f)
+}
+
+func (h *HAMT) Keys() []string {
+	keys := make([]string, 0, h.Size())
+	h.ForEach(func(key string, _ interface{}) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func (h *HAMT) String() string {
+	buf := bytes.NewBufferString("{")
+	for _, key := range h.Keys() {
+		val, _ := h.Lookup(key)
+		fmt.Fprintf(buf, "%s: %s, ", key, val)
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
@@ -0,0 +1,89 @@
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/weaveworks/ps"
+)
+
+// benchSizes mirrors the topology sizes we actually see in the field,
+// from a small host down to a large Kubernetes cluster.
+var benchSizes = []int{10000, 100000, 1000000}
+
+// buildSets constructs a Sets-like map with n keys on top of the given
+// (empty) ps.Map implementation, so the same workload can be replayed
+// against both HAMT and CustomHashmap. suffix distinguishes the value
+// stored under each key, so that building "left" and "right" with
+// different suffixes gives every key a genuinely divergent StringSet.
+func buildSets(root ps.Map, n int, suffix string) Sets {
+	s := Sets{psMap: root}
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		s = s.Add(key, MakeStringSet(key, key+suffix))
+	}
+	return s
+}
+
+// left and right are built with different suffixes so every key's
+// StringSet actually differs between them - otherwise Sets.Merge's
+// unchanged check short-circuits every key and the benchmark never
+// reaches result.Set, which is the cost this is meant to measure.
+// Successive websocket ticks reporting different topologies is the
+// realistic case this mimics.
+func BenchmarkSetsMergeHAMT(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			left := buildSets(NewHAMT(), n, "-left")
+			right := buildSets(NewHAMT(), n, "-right")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				left.Merge(right)
+			}
+		})
+	}
+}
+
+func BenchmarkSetsMergeCustomHashmap(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			right := buildSets(NewCustomHashMap(), n, "-right")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// CustomHashmap's Set mutates left in place, so left is
+				// rebuilt every iteration to keep each Merge divergent.
+				b.StopTimer()
+				left := buildSets(NewCustomHashMap(), n, "-left")
+				b.StartTimer()
+				left.Merge(right)
+			}
+		})
+	}
+}
+
+func BenchmarkSetsLookupHAMT(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			s := buildSets(NewHAMT(), n, "")
+			key := strconv.Itoa(n / 2)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Lookup(key)
+			}
+		})
+	}
+}
+
+func BenchmarkSetsLookupCustomHashmap(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			s := buildSets(NewCustomHashMap(), n, "")
+			key := strconv.Itoa(n / 2)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Lookup(key)
+			}
+		})
+	}
+}
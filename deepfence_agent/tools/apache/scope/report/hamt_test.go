@@ -0,0 +1,216 @@
+package report
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestHAMTAgainstReferenceMap runs a random sequence of Set/Delete/Lookup
+// against both a HAMT and a plain map, checking they agree at every step.
+func TestHAMTAgainstReferenceMap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ref := map[string]int{}
+	h := NewHAMT()
+
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rnd.Intn(2000))
+		if rnd.Intn(4) == 0 {
+			delete(ref, key)
+			h = h.Delete(key).(*HAMT)
+			continue
+		}
+		ref[key] = i
+		h = h.Set(key, i).(*HAMT)
+	}
+
+	if h.Size() != len(ref) {
+		t.Fatalf("Size() = %d, want %d", h.Size(), len(ref))
+	}
+	for key, want := range ref {
+		got, ok := h.Lookup(key)
+		if !ok || got.(int) != want {
+			t.Fatalf("Lookup(%q) = %v, %v; want %v, true", key, got, ok, want)
+		}
+	}
+	h.ForEach(func(key string, val interface{}) {
+		want, ok := ref[key]
+		if !ok || val.(int) != want {
+			t.Fatalf("ForEach saw stale entry %q=%v, reference has %v, %v", key, val, want, ok)
+		}
+	})
+}
+
+// TestHAMTStructuralSharing checks that Set returns a new value without
+// mutating the receiver, so older references stay valid - the property
+// the whole persistent-map design depends on.
+func TestHAMTStructuralSharing(t *testing.T) {
+	h0 := NewHAMT()
+	h1 := h0.Set("a", 1).(*HAMT)
+	h2 := h1.Set("a", 2).(*HAMT)
+
+	if _, ok := h0.Lookup("a"); ok {
+		t.Fatalf("h0 should still be empty")
+	}
+	if v, _ := h1.Lookup("a"); v.(int) != 1 {
+		t.Fatalf("h1[\"a\"] = %v, want 1", v)
+	}
+	if v, _ := h2.Lookup("a"); v.(int) != 2 {
+		t.Fatalf("h2[\"a\"] = %v, want 2", v)
+	}
+}
+
+// keysSharingPrefix searches for two distinct keys whose hamtHash agrees
+// on its bottom levels*hamtShift bits while their full hashes differ, so a
+// test can force a real trie collision without needing a true 64-bit hash
+// collision. The keys may share further bits beyond that prefix too.
+func keysSharingPrefix(t *testing.T, levels uint) (string, string) {
+	t.Helper()
+	mask := uint64(1)<<(levels*hamtShift) - 1
+	seen := map[uint64]string{}
+	for i := 0; i < 1000000; i++ {
+		key := strconv.Itoa(i)
+		h := hamtHash(key)
+		if other, ok := seen[h&mask]; ok && hamtHash(other) != h {
+			return other, key
+		}
+		seen[h&mask] = key
+	}
+	t.Fatalf("no two keys found sharing a %d-bit hash prefix", levels*hamtShift)
+	return "", ""
+}
+
+// TestHAMTLeafCollision drives two keys that land in the same trie slot
+// (a real, found hash collision on the first level, not a synthetic
+// one) through insertion, lookup and deletion, checking the leaf
+// actually splits into a branch instead of silently overwriting.
+func TestHAMTLeafCollision(t *testing.T) {
+	keyA, keyB := keysSharingPrefix(t, 1)
+
+	h := NewHAMT().Set(keyA, 1).Set(keyB, 2).(*HAMT)
+	node, ok := h.root.(*hamtNode)
+	if !ok || len(node.children) != 1 {
+		t.Fatalf("expected a 1-child branch from the colliding slot, got %#v", h.root)
+	}
+
+	if v, ok := h.Lookup(keyA); !ok || v.(int) != 1 {
+		t.Fatalf("Lookup(%q) = %v, %v; want 1, true", keyA, v, ok)
+	}
+	if v, ok := h.Lookup(keyB); !ok || v.(int) != 2 {
+		t.Fatalf("Lookup(%q) = %v, %v; want 2, true", keyB, v, ok)
+	}
+
+	h = h.Delete(keyA).(*HAMT)
+	if _, ok := h.Lookup(keyA); ok {
+		t.Fatalf("%q should be gone", keyA)
+	}
+	if v, ok := h.Lookup(keyB); !ok || v.(int) != 2 {
+		t.Fatalf("%q should survive deleting %q, got %v, %v", keyB, keyA, v, ok)
+	}
+}
+
+// TestHAMTCollisionBucketAtMaxShift checks the fallback used once two
+// keys share every bit consumed by the trie (shift has reached
+// hamtMaxShift): rather than recursing forever, they're kept together
+// in one leaf's entries slice.
+func TestHAMTCollisionBucketAtMaxShift(t *testing.T) {
+	const hash = 0xabc
+	n, _ := hamtSet(nil, hash, hamtMaxShift, "x", 1)
+	n, isNew := hamtSet(n, hash, hamtMaxShift, "y", 2)
+	if !isNew {
+		t.Fatalf("expected y to be new")
+	}
+	leaf, ok := n.(*hamtLeaf)
+	if !ok || len(leaf.entries) != 2 {
+		t.Fatalf("expected a 2-entry collision bucket, got %#v", n)
+	}
+
+	n, deleted := hamtDelete(n, hash, hamtMaxShift, "x")
+	if !deleted {
+		t.Fatalf("expected x to be deleted")
+	}
+	if _, ok := hamtLookup(n, hash, hamtMaxShift, "x"); ok {
+		t.Fatalf("x should be gone")
+	}
+	if v, ok := hamtLookup(n, hash, hamtMaxShift, "y"); !ok || v.(int) != 2 {
+		t.Fatalf("y should survive, got %v, %v", v, ok)
+	}
+}
+
+// TestHAMTDeleteToEmpty checks that deleting the only key collapses the
+// trie all the way back to nil, not a dangling empty node.
+func TestHAMTDeleteToEmpty(t *testing.T) {
+	h := NewHAMT().Set("only", 1).(*HAMT)
+	h = h.Delete("only").(*HAMT)
+	if h.Size() != 0 || h.root != nil {
+		t.Fatalf("expected an empty trie, got size=%d root=%#v", h.Size(), h.root)
+	}
+}
+
+// TestHAMTPartialCollisionDivergence checks two keys that share their
+// first level's slot but diverge at the next one: they should separate
+// into their own leaves one level down rather than colliding forever.
+func TestHAMTPartialCollisionDivergence(t *testing.T) {
+	keyA, keyB := keysSharingPrefix(t, 1)
+	if keysShareLevel2 := hamtHash(keyA)>>hamtShift&hamtMask == hamtHash(keyB)>>hamtShift&hamtMask; keysShareLevel2 {
+		t.Fatalf("test fixture keys %q/%q unexpectedly also collide at the second level", keyA, keyB)
+	}
+
+	h := NewHAMT().Set(keyA, 1).Set(keyB, 2).(*HAMT)
+	node, ok := h.root.(*hamtNode)
+	if !ok || len(node.children) != 1 {
+		t.Fatalf("expected a 1-child branch from the shared first level, got %#v", h.root)
+	}
+	child, ok := node.children[0].(*hamtNode)
+	if !ok || len(child.children) != 2 {
+		t.Fatalf("expected the keys to separate into 2 leaves one level down, got %#v", node.children[0])
+	}
+
+	if v, ok := h.Lookup(keyA); !ok || v.(int) != 1 {
+		t.Fatalf("Lookup(%q) = %v, %v; want 1, true", keyA, v, ok)
+	}
+	if v, ok := h.Lookup(keyB); !ok || v.(int) != 2 {
+		t.Fatalf("Lookup(%q) = %v, %v; want 2, true", keyB, v, ok)
+	}
+}
+
+// TestHAMTConcurrentReadDerive checks the property the whole series is
+// premised on: readers can keep using one HAMT value while other
+// goroutines derive new versions from it via Set, with no locking on
+// either side. Run with -race to catch any structural sharing that
+// isn't actually safe to share.
+func TestHAMTConcurrentReadDerive(t *testing.T) {
+	base := NewHAMT()
+	for i := 0; i < 1000; i++ {
+		base = base.Set(strconv.Itoa(i), i).(*HAMT)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			derived := base
+			for i := 0; i < 1000; i++ {
+				derived = derived.Set(fmt.Sprintf("g%d-%d", g, i), i).(*HAMT)
+			}
+			for i := 0; i < 1000; i++ {
+				if v, ok := derived.Lookup(fmt.Sprintf("g%d-%d", g, i)); !ok || v.(int) != i {
+					t.Errorf("goroutine %d: lookup g%d-%d = %v, %v; want %v, true", g, g, i, v, ok, i)
+				}
+			}
+		}(g)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if _, ok := base.Lookup(strconv.Itoa(i)); !ok {
+					t.Errorf("base lookup %d missing while being read concurrently", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
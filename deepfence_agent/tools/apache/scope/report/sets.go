@@ -10,13 +10,15 @@ import (
 	"github.com/weaveworks/ps"
 )
 
-var customHashMap = &CustomHashmap{
-	Map: map[string]interface{}{},
-	mu:  sync.RWMutex{},
-}
-
+// CustomHashmap is a map[string]interface{} guarded by a single
+// RWMutex, wearing a ps.Map interface. It predates HAMT and is kept
+// around only as the baseline in the Merge/Lookup benchmarks in
+// hamt_bench_test.go -
+// Sets itself is backed by HAMT, which is actually persistent.
 func NewCustomHashMap() *CustomHashmap {
-	return customHashMap
+	return &CustomHashmap{
+		Map: map[string]interface{}{},
+	}
 }
 
 type CustomHashmap struct {
@@ -102,7 +104,7 @@ type Sets struct {
 }
 
 // EmptySets is an empty Sets.  Starts with this.
-var emptySets = Sets{NewCustomHashMap()}
+var emptySets = Sets{NewHAMT()}
 
 // MakeSets returns EmptySets
 func MakeSets() Sets {